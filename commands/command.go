@@ -0,0 +1,25 @@
+package commands
+
+// Command is the dispatch node for a single API command, and, as the tree
+// root handed to http.NewHandler, for the whole command tree. Only the
+// fields the HTTP transport consults are declared here; the rest of
+// Command (Options, Arguments, Run, ...) lives alongside it.
+type Command struct {
+	// AuthRequired gates this command behind authentication at the HTTP
+	// layer: ServerConfig.Authenticator must resolve a non-empty identity
+	// before the command is allowed to run. See
+	// commands/http.internalHandler.authorizeCommand.
+	AuthRequired bool
+
+	// Compress opts a streamed response into gzip compression even though
+	// its total size isn't known ahead of time. Buffered responses are
+	// compressed once they reach ServerConfig.CompressionMinSize; with
+	// Compress set they're compressed regardless of size. See
+	// commands/http.negotiateCompression.
+	Compress bool
+
+	// Subcommands are this command's named children, keyed by path
+	// segment (e.g. "add" under the "pin" Command). A command path like
+	// "pin/add" is resolved by walking Subcommands one segment at a time.
+	Subcommands map[string]*Command
+}
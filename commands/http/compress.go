@@ -0,0 +1,89 @@
+package http
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+
+	cmds "github.com/ipfs/go-ipfs/commands"
+)
+
+// negotiateCompression decides whether the response to r should be gzip
+// encoded, returning the gzip level to use. A streamed response (isStream)
+// is only compressed when the resolved command opts in via
+// Command.Compress, since its total size isn't known ahead of time;
+// buffered responses are compressed whenever they clear
+// cfg.CompressionMinSize. Compression always requires an http.Flusher, so
+// the legacy hijack path (see writeResponseHijack) never has to know
+// about it.
+func negotiateCompression(w http.ResponseWriter, r *http.Request, cfg *ServerConfig, req cmds.Request, res cmds.Response, isStream bool) (level int, ok bool) {
+	if cfg == nil || !acceptsGzip(r) {
+		return 0, false
+	}
+	if _, canFlush := w.(http.Flusher); !canFlush {
+		return 0, false
+	}
+
+	forced := req.Command() != nil && req.Command().Compress
+	if isStream {
+		if !forced {
+			return 0, false
+		}
+	} else if !forced && res.Length() < uint64(cfg.CompressionMinSize) {
+		return 0, false
+	}
+
+	level = gzip.DefaultCompression
+	if cfg.CompressionLevel != nil {
+		level = *cfg.CompressionLevel
+	}
+	return level, true
+}
+
+// acceptsGzip reports whether r's Accept-Encoding header allows gzip,
+// honoring "q=0" (and wildcard "*") the way RFC 7231 defines them: an
+// explicit "gzip" entry decides on its own, so "gzip;q=0" excludes gzip
+// even if "*" would otherwise allow it.
+func acceptsGzip(r *http.Request) bool {
+	header := r.Header.Get(acceptEncodingHeader)
+	if header == "" {
+		return false
+	}
+
+	gzipQ, starQ := -1.0, -1.0
+	for _, enc := range strings.Split(header, ",") {
+		name, q := parseEncodingPreference(enc)
+		switch name {
+		case "gzip":
+			gzipQ = q
+		case "*":
+			starQ = q
+		}
+	}
+
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return starQ > 0
+}
+
+// parseEncodingPreference splits one Accept-Encoding token (e.g.
+// "gzip;q=0.5") into its coding name and quality value, defaulting the
+// quality to 1 when no "q" parameter is present.
+func parseEncodingPreference(enc string) (name string, q float64) {
+	q = 1
+	parts := strings.Split(enc, ";")
+	name = strings.TrimSpace(parts[0])
+	for _, param := range parts[1:] {
+		param = strings.TrimSpace(param)
+		v := strings.TrimPrefix(param, "q=")
+		if v == param {
+			continue
+		}
+		if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+			q = parsed
+		}
+	}
+	return name, q
+}
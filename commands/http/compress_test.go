@@ -0,0 +1,57 @@
+package http
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	cases := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate", false},
+		{"gzip, deflate", true},
+		{"*", true},
+		{"gzip;q=0", false},
+		{"gzip;q=0.5", true},
+		{"*;q=0", false},
+		{"deflate, *;q=0.1", true},
+		{"gzip;q=0, *", false},
+		{"br, gzip;q=1.0", true},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/api/v0/cat?arg=QmFoo", nil)
+		if c.header != "" {
+			req.Header.Set(acceptEncodingHeader, c.header)
+		}
+		if got := acceptsGzip(req); got != c.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", c.header, got, c.want)
+		}
+	}
+}
+
+func TestParseEncodingPreference(t *testing.T) {
+	cases := []struct {
+		enc      string
+		wantName string
+		wantQ    float64
+	}{
+		{"gzip", "gzip", 1},
+		{"gzip;q=0.5", "gzip", 0.5},
+		{" gzip ; q=0.8 ", "gzip", 0.8},
+		{"*;q=0", "*", 0},
+		{"gzip;q=notanumber", "gzip", 1},
+	}
+
+	for _, c := range cases {
+		name, q := parseEncodingPreference(c.enc)
+		if name != c.wantName || q != c.wantQ {
+			t.Errorf("parseEncodingPreference(%q) = (%q, %v), want (%q, %v)",
+				c.enc, name, q, c.wantName, c.wantQ)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package http
 
 import (
 	"bufio"
+	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
@@ -9,7 +10,9 @@ import (
 	"strconv"
 	"strings"
 
+	context "github.com/ipfs/go-ipfs/Godeps/_workspace/src/golang.org/x/net/context"
 	cors "github.com/ipfs/go-ipfs/Godeps/_workspace/src/github.com/rs/cors"
+	prometheus "github.com/ipfs/go-ipfs/Godeps/_workspace/src/github.com/prometheus/client_golang/prometheus"
 
 	cmds "github.com/ipfs/go-ipfs/commands"
 	u "github.com/ipfs/go-ipfs/util"
@@ -24,11 +27,10 @@ type internalHandler struct {
 	cfg  *ServerConfig
 }
 
-// The Handler struct is funny because we want to wrap our internal handler
-// with CORS while keeping our fields.
+// Handler wraps internalHandler with CORS preflight/policy handling while
+// keeping its fields (and the ctx/root/cfg they expose) directly accessible.
 type Handler struct {
 	internalHandler
-	corsHandler http.Handler
 }
 
 var ErrNotFound = errors.New("404 page not found")
@@ -42,6 +44,8 @@ const (
 	contentLengthHeader    = "Content-Length"
 	contentDispHeader      = "Content-Disposition"
 	transferEncodingHeader = "Transfer-Encoding"
+	contentEncodingHeader  = "Content-Encoding"
+	acceptEncodingHeader   = "Accept-Encoding"
 	applicationJson        = "application/json"
 	applicationOctetStream = "application/octet-stream"
 	plainText              = "text/plain"
@@ -64,8 +68,51 @@ type ServerConfig struct {
 	// Headers is an optional map of headers that is written out.
 	Headers map[string][]string
 
-	// CORSOpts is a set of options for CORS headers.
+	// CORSOpts is the default set of options for CORS headers, used for any
+	// command that isn't matched by a more specific entry in CORSPolicies.
 	CORSOpts *cors.Options
+
+	// CORSPolicies lets operators override CORSOpts for specific commands,
+	// e.g. a stricter policy for mutating endpoints like "add" or "pin" and
+	// a looser one for read-only endpoints like "cat" or "ls".
+	CORSPolicies []CORSPolicy
+
+	// Authenticator, if set, is consulted before every command dispatch.
+	// Commands with Command.AuthRequired set are rejected unless it
+	// returns a non-empty identity; this lets operators expose the API
+	// beyond localhost without relying on the CORS origin allowlist as a
+	// de-facto access control.
+	Authenticator Authenticator
+
+	// MetricsPath, if non-empty, serves Prometheus metrics for the API
+	// (requests_total, request_duration_seconds, ...) at that path, e.g.
+	// "/metrics". Every other request except a CORS preflight (which is
+	// answered before dispatch) is also instrumented against these metrics
+	// regardless of whether MetricsPath is set.
+	MetricsPath string
+
+	// CompressionLevel is the gzip level used when compressing responses,
+	// as in compress/gzip (gzip.DefaultCompression, gzip.BestSpeed, ...).
+	// Nil means gzip.DefaultCompression; it's a pointer rather than a
+	// plain int so that gzip.NoCompression (0) can be configured
+	// explicitly without being mistaken for "unset".
+	CompressionLevel *int
+
+	// CompressionMinSize is the minimum response size, in bytes, worth
+	// compressing. It only applies when the response size is known ahead
+	// of time (res.Length()); streamed responses are compressed whenever
+	// a command opts in via Command.Compress, regardless of size.
+	CompressionMinSize int64
+}
+
+// CORSPolicy associates a set of CORS options with the commands it applies
+// to. Commands is matched against the command path (e.g. "pin/add"); an
+// entry whose Commands is empty never matches. The first policy with a
+// matching command wins,
+// and ServerConfig.CORSOpts is used when nothing matches.
+type CORSPolicy struct {
+	Commands []string
+	Options  *cors.Options
 }
 
 func skipAPIHeader(h string) bool {
@@ -74,7 +121,10 @@ func skipAPIHeader(h string) bool {
 		return false
 	case "Access-Control-Allow-Origin":
 	case "Access-Control-Allow-Methods":
+	case "Access-Control-Allow-Headers":
 	case "Access-Control-Allow-Credentials":
+	case "Access-Control-Expose-Headers":
+	case "Access-Control-Max-Age":
 	}
 	return true
 }
@@ -84,35 +134,159 @@ func NewHandler(ctx cmds.Context, root *cmds.Command, cfg *ServerConfig) *Handle
 		cfg = &ServerConfig{}
 	}
 
-	if cfg.CORSOpts == nil {
-		cfg.CORSOpts = new(cors.Options)
+	cfg.CORSOpts = setCORSDefaults(cfg.CORSOpts)
+	for i, p := range cfg.CORSPolicies {
+		cfg.CORSPolicies[i].Options = setCORSDefaults(p.Options)
+	}
+
+	internal := internalHandler{ctx, root, cfg}
+	return &Handler{internal}
+}
+
+// setCORSDefaults fills in the zero-value fields of opts with the handler's
+// defaults and returns it (allocating a fresh *cors.Options if opts is nil).
+func setCORSDefaults(opts *cors.Options) *cors.Options {
+	if opts == nil {
+		opts = new(cors.Options)
 	}
 
 	// by default, use GET, PUT, POST
-	if cfg.CORSOpts.AllowedMethods == nil {
-		cfg.CORSOpts.AllowedMethods = []string{"GET", "POST", "PUT"}
+	if opts.AllowedMethods == nil {
+		opts.AllowedMethods = []string{"GET", "POST", "PUT"}
 	}
 
 	// by default, only let 127.0.0.1 through.
-	if cfg.CORSOpts.AllowedOrigins == nil {
-		cfg.CORSOpts.AllowedOrigins = localhostOrigins
+	if opts.AllowedOrigins == nil {
+		opts.AllowedOrigins = localhostOrigins
 	}
 
-	// Wrap the internal handler with CORS handling-middleware.
-	// Create a handler for the API.
-	internal := internalHandler{ctx, root, cfg}
-	c := cors.New(*cfg.CORSOpts)
-	return &Handler{internal, c.Handler(internal)}
+	return opts
+}
+
+// corsPolicyFor returns the CORS options that apply to the given command
+// path, falling back to cfg.CORSOpts when no per-command policy matches.
+func corsPolicyFor(cfg *ServerConfig, cmdPath string) *cors.Options {
+	for _, p := range cfg.CORSPolicies {
+		for _, c := range p.Commands {
+			if c == cmdPath {
+				return p.Options
+			}
+		}
+	}
+	return cfg.CORSOpts
+}
+
+func commandPath(r *http.Request) string {
+	p := strings.TrimPrefix(r.URL.Path, "/api/v0/")
+	p = strings.TrimPrefix(p, "/api/v0")
+	return strings.Trim(p, "/")
+}
+
+// originAllowed matches origin against opts.AllowedOrigins by exact string
+// or "*"; unlike rs/cors, it doesn't support wildcard-subdomain patterns
+// (e.g. "https://*.example.com"). AllowedOrigins entries are expected to
+// be fully-specified origins.
+func originAllowed(opts *cors.Options, origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, o := range opts.AllowedOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCORSHeaders sets the response headers common to both preflight and
+// actual requests, for the policy matching the request's command.
+func writeCORSHeaders(w http.ResponseWriter, r *http.Request, opts *cors.Options) {
+	origin := r.Header.Get("Origin")
+	if !originAllowed(opts, origin) {
+		return
+	}
+
+	h := w.Header()
+	// the allow-origin value below is echoed back per-request rather than
+	// a fixed "*", so a cache sitting in front of this handler needs to
+	// know the response varies by Origin - otherwise it could serve one
+	// origin's allow-origin value to a different origin.
+	h.Add("Vary", "Origin")
+	h.Set("Access-Control-Allow-Origin", origin)
+	if opts.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(opts.ExposedHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(opts.ExposedHeaders, ", "))
+	}
+}
+
+// handlePreflight answers a CORS preflight (OPTIONS) request directly,
+// without dispatching it to a command, and reports whether it did so.
+func handlePreflight(w http.ResponseWriter, r *http.Request, opts *cors.Options) bool {
+	if r.Method != "OPTIONS" || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+
+	writeCORSHeaders(w, r, opts)
+
+	h := w.Header()
+	if len(opts.AllowedMethods) > 0 {
+		h.Set("Access-Control-Allow-Methods", strings.Join(opts.AllowedMethods, ", "))
+	}
+	if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+		if len(opts.AllowedHeaders) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(opts.AllowedHeaders, ", "))
+		} else {
+			// mirror the requested headers back, same as most CORS libraries do
+			// when AllowedHeaders isn't configured.
+			h.Set("Access-Control-Allow-Headers", reqHeaders)
+		}
+	}
+	if opts.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(opts.MaxAge))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return true
 }
 
 func (i Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Call the CORS handler which wraps the internal handler.
-	i.corsHandler.ServeHTTP(w, r)
+	opts := corsPolicyFor(i.cfg, commandPath(r))
+
+	// short-circuit preflight requests; they never reach a command.
+	if handlePreflight(w, r, opts) {
+		return
+	}
+
+	writeCORSHeaders(w, r, opts)
+
+	if i.cfg.MetricsPath != "" && r.Method == "GET" && r.URL.Path == i.cfg.MetricsPath {
+		prometheus.Handler().ServeHTTP(w, r)
+		return
+	}
+
+	if r.Method == "POST" && r.URL.Path == rpcPath {
+		instrumented(w, r, rpcPath, i.internalHandler.handleRPC)
+		return
+	}
+
+	cmdPath := commandLabel(i.root, commandPath(r))
+	instrumented(w, r, cmdPath, i.internalHandler.ServeHTTP)
 }
 
 func (i internalHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Debug("Incoming API request: ", r.URL)
 
+	// authenticate before Parse: an HMAC-signed request's signature covers
+	// the request body, so it has to run (and restore r.Body) before
+	// anything else drains it.
+	identity, err := i.authenticate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
 	req, err := Parse(r, i.root)
 	if err != nil {
 		if err == ErrNotFound {
@@ -124,19 +298,12 @@ func (i internalHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// get the node's context to pass into the commands.
-	node, err := i.ctx.GetNode()
-	if err != nil {
-		s := fmt.Sprintf("cmds/http: couldn't GetNode(): %s", err)
-		http.Error(w, s, http.StatusInternalServerError)
-		return
-	}
-
-	//ps: take note of the name clash - commands.Context != context.Context
-	req.SetInvocContext(i.ctx)
-	err = req.SetRootContext(node.Context())
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := i.authorizeCommand(req, identity); err != nil {
+		status := http.StatusInternalServerError
+		if err == ErrUnauthorized {
+			status = http.StatusUnauthorized
+		}
+		http.Error(w, err.Error(), status)
 		return
 	}
 
@@ -151,7 +318,41 @@ func (i internalHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// now handle responding to the client properly
-	sendResponse(w, r, req, res)
+	sendResponse(w, r, req, res, i.cfg)
+}
+
+// authorizeCommand rejects the dispatch with ErrUnauthorized if cmdReq
+// resolved to a command with AuthRequired set and no identity was
+// established by i.authenticate, and otherwise binds the (possibly
+// identified) request context. It's shared by every transport (REST-ish
+// and JSON-RPC) that dispatches through root, each of which calls
+// i.authenticate itself - once per incoming HTTP request, before that
+// request's body is consumed for anything else.
+func (i internalHandler) authorizeCommand(cmdReq cmds.Request, identity string) error {
+	if cmdReq.Command() != nil && cmdReq.Command().AuthRequired && identity == "" {
+		return ErrUnauthorized
+	}
+	return i.bindContext(cmdReq, identity)
+}
+
+// bindContext wires the invocation and root contexts into req.
+// identity, if non-empty, is the value an Authenticator authenticated the
+// request as, and is made available to commands via IdentityFromContext.
+func (i internalHandler) bindContext(req cmds.Request, identity string) error {
+	// get the node's context to pass into the commands.
+	node, err := i.ctx.GetNode()
+	if err != nil {
+		return fmt.Errorf("cmds/http: couldn't GetNode(): %s", err)
+	}
+
+	//ps: take note of the name clash - commands.Context != context.Context
+	req.SetInvocContext(i.ctx)
+
+	rootCtx := node.Context()
+	if identity != "" {
+		rootCtx = context.WithValue(rootCtx, identityContextKey{}, identity)
+	}
+	return req.SetRootContext(rootCtx)
 }
 
 func guessMimeType(res cmds.Response) (string, error) {
@@ -167,7 +368,7 @@ func guessMimeType(res cmds.Response) (string, error) {
 	return mimeTypes[enc], nil
 }
 
-func sendResponse(w http.ResponseWriter, r *http.Request, req cmds.Request, res cmds.Response) {
+func sendResponse(w http.ResponseWriter, r *http.Request, req cmds.Request, res cmds.Response, cfg *ServerConfig) {
 	mime, err := guessMimeType(res)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -190,13 +391,17 @@ func sendResponse(w http.ResponseWriter, r *http.Request, req cmds.Request, res
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if oc, ok := w.(outputCounter); ok {
+		out = oc.countOutput(out)
+	}
 
 	h := w.Header()
 	if res.Length() > 0 {
 		h.Set(contentLengthHeader, strconv.FormatUint(res.Length(), 10))
 	}
 
-	if _, ok := res.Output().(io.Reader); ok {
+	_, isStream := res.Output().(io.Reader)
+	if isStream {
 		// we don't set the Content-Type for streams, so that browsers can MIME-sniff the type themselves
 		// we set this header so clients have a way to know this is an output stream
 		// (not marshalled command output)
@@ -229,20 +434,110 @@ func sendResponse(w http.ResponseWriter, r *http.Request, req cmds.Request, res
 		return
 	}
 
-	if err := writeResponse(status, w, out); err != nil {
+	gzipLevel, gzipEncode := negotiateCompression(w, r, cfg, req, res, isStream || isChan)
+	if gzipEncode {
+		h.Set(contentEncodingHeader, "gzip")
+		h.Del(contentLengthHeader)
+	}
+
+	if err := writeResponse(w, status, out, gzipEncode, gzipLevel); err != nil {
 		log.Error("error while writing stream", err)
 	}
 }
 
-// Copies from an io.Reader to a http.ResponseWriter.
-// Flushes chunks over HTTP stream as they are read (if supported by transport).
-func writeResponse(status int, w http.ResponseWriter, out io.Reader) error {
-	// hijack the connection so we can write our own chunked output and trailers
+// writeResponse copies from out to w, flushing chunks over the HTTP stream
+// as they are read and delivering a stream error (if any) as a trailer.
+//
+// The modern path uses http.Flusher, which net/http's own chunked-transfer
+// writer and trailer support understands natively (and which works fine
+// over HTTP/2, where there is no Hijacker at all). Hijacking is kept only
+// as a fallback for HTTP/1.1 ResponseWriters that, for whatever reason,
+// don't implement http.Flusher.
+func writeResponse(w http.ResponseWriter, status int, out io.Reader, gzipEncode bool, gzipLevel int) error {
+	if flusher, ok := w.(http.Flusher); ok {
+		return writeResponseFlusher(w, flusher, status, out, gzipEncode, gzipLevel)
+	}
+
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
-		log.Error("Failed to create hijacker! cannot continue!")
-		return errors.New("Could not create hijacker")
+		log.Error("ResponseWriter supports neither Flusher nor Hijacker! cannot continue!")
+		return errors.New("could not create hijacker")
 	}
+	return writeResponseHijack(hijacker, w.Header(), status, out)
+}
+
+// writeResponseFlusher streams out over w using standard chunked transfer
+// encoding, flushing after every chunk read. The stream error, if any, is
+// declared up front via the Trailer header and set on w.Header() once the
+// body is done, exactly as net/http expects for trailers on a streamed
+// response. When gzipEncode is set, out is compressed on the fly; the
+// gzip writer is flushed alongside every chunk and closed before the
+// trailer is set, so the client sees a well-formed gzip stream even if
+// the command output is being streamed chunk by chunk.
+func writeResponseFlusher(w http.ResponseWriter, flusher http.Flusher, status int, out io.Reader, gzipEncode bool, gzipLevel int) error {
+	w.Header().Set("Trailer", StreamErrHeader)
+	w.WriteHeader(status)
+
+	var bodyWriter io.Writer = w
+	var gz *gzip.Writer
+	if gzipEncode {
+		var err error
+		gz, err = gzip.NewWriterLevel(w, gzipLevel)
+		if err != nil {
+			gz = gzip.NewWriter(w)
+		}
+		bodyWriter = gz
+	}
+
+	streamErr := writeChunksFlusher(out, bodyWriter, flusher)
+	if gz != nil {
+		if cerr := gz.Close(); cerr != nil && streamErr == nil {
+			streamErr = cerr
+		}
+	}
+	if streamErr != nil {
+		w.Header().Set(StreamErrHeader, sanitizedErrStr(streamErr))
+	}
+	return streamErr
+}
+
+func writeChunksFlusher(r io.Reader, w io.Writer, flusher http.Flusher) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+
+		if n > 0 {
+			if _, werr := w.Write(buf[0:n]); werr != nil {
+				return werr
+			}
+			if f, ok := w.(flushableWriter); ok {
+				f.Flush()
+			}
+			flusher.Flush()
+		}
+
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return nil
+}
+
+// flushableWriter is satisfied by *gzip.Writer: flushing it pushes any
+// buffered compressed bytes to the underlying writer without closing the
+// stream, which is what keeps compression from breaking chunk-by-chunk
+// streaming semantics.
+type flushableWriter interface {
+	Flush() error
+}
+
+// writeResponseHijack is the legacy path: it hijacks the connection and
+// writes the chunked framing and trailer by hand. Only reachable when the
+// transport offers a Hijacker but no Flusher.
+func writeResponseHijack(hijacker http.Hijacker, headers http.Header, status int, out io.Reader) error {
 	conn, writer, err := hijacker.Hijack()
 	if err != nil {
 		return err
@@ -253,7 +548,7 @@ func writeResponse(status int, w http.ResponseWriter, out io.Reader) error {
 	writer.WriteString(fmt.Sprintf("HTTP/1.1 %d %s\r\n", status, http.StatusText(status)))
 
 	// Write out headers
-	w.Header().Write(writer)
+	headers.Write(writer)
 
 	// end of headers
 	writer.WriteString("\r\n")
@@ -0,0 +1,112 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	cors "github.com/ipfs/go-ipfs/Godeps/_workspace/src/github.com/rs/cors"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	opts := &cors.Options{AllowedOrigins: []string{"http://127.0.0.1", "https://example.com"}}
+
+	cases := []struct {
+		origin string
+		want   bool
+	}{
+		{"http://127.0.0.1", true},
+		{"https://example.com", true},
+		{"https://evil.example", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		if got := originAllowed(opts, c.origin); got != c.want {
+			t.Errorf("originAllowed(%q) = %v, want %v", c.origin, got, c.want)
+		}
+	}
+
+	wildcard := &cors.Options{AllowedOrigins: []string{"*"}}
+	if !originAllowed(wildcard, "https://anything.example") {
+		t.Error("originAllowed() = false for \"*\" policy, want true")
+	}
+}
+
+func TestWriteCORSHeadersMatchedOrigin(t *testing.T) {
+	opts := &cors.Options{AllowedOrigins: []string{"https://example.com"}, AllowCredentials: true}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/v0/pin/ls", nil)
+	req.Header.Set("Origin", "https://example.com")
+
+	writeCORSHeaders(rec, req, opts)
+
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://example.com" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, "https://example.com")
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("Access-Control-Allow-Credentials = %q, want %q", got, "true")
+	}
+	if got := rec.Header().Get("Vary"); got != "Origin" {
+		t.Errorf("Vary = %q, want %q", got, "Origin")
+	}
+}
+
+func TestWriteCORSHeadersUnmatchedOrigin(t *testing.T) {
+	opts := &cors.Options{AllowedOrigins: []string{"https://example.com"}}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/v0/pin/ls", nil)
+	req.Header.Set("Origin", "https://evil.example")
+
+	writeCORSHeaders(rec, req, opts)
+
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want empty for an unmatched origin", got)
+	}
+	if got := rec.Header().Get("Vary"); got != "" {
+		t.Errorf("Vary = %q, want empty for an unmatched origin", got)
+	}
+}
+
+func TestHandlePreflight(t *testing.T) {
+	opts := &cors.Options{
+		AllowedOrigins: []string{"https://example.com"},
+		AllowedMethods: []string{"GET", "POST"},
+		MaxAge:         600,
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("OPTIONS", "/api/v0/pin/add", nil)
+	req.Header.Set("Origin", "https://example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "X-Custom")
+
+	if handled := handlePreflight(rec, req, opts); !handled {
+		t.Fatal("handlePreflight() = false, want true for a CORS preflight request")
+	}
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Methods"); got != "GET, POST" {
+		t.Errorf("Access-Control-Allow-Methods = %q, want %q", got, "GET, POST")
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Headers"); got != "X-Custom" {
+		t.Errorf("Access-Control-Allow-Headers = %q, want %q", got, "X-Custom")
+	}
+	if got := rec.Header().Get("Access-Control-Max-Age"); got != "600" {
+		t.Errorf("Access-Control-Max-Age = %q, want %q", got, "600")
+	}
+}
+
+func TestHandlePreflightIgnoresNonPreflightRequests(t *testing.T) {
+	opts := &cors.Options{AllowedOrigins: []string{"*"}}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/v0/pin/ls", nil)
+	req.Header.Set("Origin", "https://example.com")
+
+	if handled := handlePreflight(rec, req, opts); handled {
+		t.Error("handlePreflight() = true for a plain GET request, want false")
+	}
+}
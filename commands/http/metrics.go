@@ -0,0 +1,222 @@
+package http
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	prometheus "github.com/ipfs/go-ipfs/Godeps/_workspace/src/github.com/prometheus/client_golang/prometheus"
+
+	cmds "github.com/ipfs/go-ipfs/commands"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "api",
+		Name:      "requests_total",
+		Help:      "Number of API requests handled, by command and status.",
+	}, []string{"command", "status"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ipfs",
+		Subsystem: "api",
+		Name:      "request_duration_seconds",
+		Help:      "API request latency in seconds, by command.",
+	}, []string{"command"})
+
+	requestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ipfs",
+		Subsystem: "api",
+		Name:      "requests_in_flight",
+		Help:      "Number of API requests currently being served.",
+	})
+
+	requestBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "api",
+		Name:      "request_bytes_total",
+		Help:      "Bytes read from API request bodies, by command.",
+	}, []string{"command"})
+
+	responseBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "api",
+		Name:      "response_bytes_total",
+		Help:      "Bytes streamed out in /api/v0 command responses, by command. JSON-RPC responses are not counted.",
+	}, []string{"command"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal)
+	prometheus.MustRegister(requestDuration)
+	prometheus.MustRegister(requestsInFlight)
+	prometheus.MustRegister(requestBytesTotal)
+	prometheus.MustRegister(responseBytesTotal)
+}
+
+// countingReader wraps an io.Reader, tallying bytes read into n.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// outputCounter is implemented by response writers that want to observe
+// how many bytes are streamed through res.Reader(). That can't be done by
+// intercepting ResponseWriter.Write, because a response may get hijacked
+// (see writeResponseHijack) and write its body straight to the connection,
+// bypassing Write entirely - so sendResponse asks the writer to wrap the
+// reader instead.
+type outputCounter interface {
+	countOutput(io.Reader) io.Reader
+}
+
+// statusResponseWriter records the status code written and, via
+// countOutput, the bytes streamed out in the response body.
+//
+// It deliberately does NOT declare Flush/Hijack itself: a method declared
+// here would make every statusResponseWriter satisfy http.Flusher (or
+// http.Hijacker) regardless of whether the real underlying transport
+// does, which would make writeResponse's w.(http.Flusher) check always
+// true, permanently dead-code the writeResponseHijack fallback, and make
+// negotiateCompression's flusher check meaningless. newStatusResponseWriter
+// instead wraps in an additional struct embedding the real
+// http.Flusher/http.Hijacker only when the wrapped writer has one, so the
+// capability is forwarded rather than faked.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+	out    countingReader
+}
+
+func (s *statusResponseWriter) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusResponseWriter) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+func (s *statusResponseWriter) countOutput(r io.Reader) io.Reader {
+	s.out.Reader = r
+	return &s.out
+}
+
+// newStatusResponseWriter wraps w for instrumented(), returning both the
+// http.ResponseWriter to hand to the dispatched handler and the
+// statusResponseWriter underlying it, for reading back status/byte
+// counts once the handler returns. The returned ResponseWriter implements
+// http.Flusher and/or http.Hijacker exactly when w does.
+func newStatusResponseWriter(w http.ResponseWriter) (http.ResponseWriter, *statusResponseWriter) {
+	base := &statusResponseWriter{ResponseWriter: w}
+	flusher, isFlusher := w.(http.Flusher)
+	hijacker, isHijacker := w.(http.Hijacker)
+
+	switch {
+	case isFlusher && isHijacker:
+		return &flusherHijackerResponseWriter{base, flusher, hijacker}, base
+	case isFlusher:
+		return &flusherResponseWriter{base, flusher}, base
+	case isHijacker:
+		return &hijackerResponseWriter{base, hijacker}, base
+	default:
+		return base, base
+	}
+}
+
+type flusherResponseWriter struct {
+	*statusResponseWriter
+	http.Flusher
+}
+
+// hijackerResponseWriter forwards Hijack straight to the underlying
+// Hijacker. Once a handler hijacks the connection it writes the status
+// line by hand, which statusResponseWriter has no way to observe - so
+// base.status stays 0 (logged/labeled as http.StatusOK by instrumented).
+type hijackerResponseWriter struct {
+	*statusResponseWriter
+	http.Hijacker
+}
+
+type flusherHijackerResponseWriter struct {
+	*statusResponseWriter
+	http.Flusher
+	http.Hijacker
+}
+
+// unknownCommandLabel is the Prometheus "command" label value recorded for
+// a request whose path doesn't resolve to a known command, so that
+// unmatched or attacker-controlled paths can't generate unbounded label
+// cardinality.
+const unknownCommandLabel = "unknown"
+
+// commandLabel resolves cmdPath (e.g. "pin/add") against root's
+// Subcommands tree, returning it unchanged if every segment matches a
+// known command, and unknownCommandLabel otherwise. cmdPath is derived
+// from the raw, client-supplied URL path, so it must be validated before
+// it's ever used as a metrics label.
+func commandLabel(root *cmds.Command, cmdPath string) string {
+	if cmdPath == "" {
+		return cmdPath
+	}
+
+	cur := root
+	for _, seg := range strings.Split(cmdPath, "/") {
+		if cur.Subcommands == nil {
+			return unknownCommandLabel
+		}
+		next, ok := cur.Subcommands[seg]
+		if !ok {
+			return unknownCommandLabel
+		}
+		cur = next
+	}
+	return cmdPath
+}
+
+// instrumented wraps a single API request dispatch with Prometheus metrics
+// and a structured log line: command, status, duration, bytes in/out,
+// remote address and user-agent. cmdPath must already be validated (see
+// commandLabel) - it's used directly as a label value.
+func instrumented(w http.ResponseWriter, r *http.Request, cmdPath string, next func(http.ResponseWriter, *http.Request)) {
+	requestsInFlight.Inc()
+	defer requestsInFlight.Dec()
+
+	start := time.Now()
+
+	in := &countingReader{Reader: r.Body}
+	r.Body = ioutil.NopCloser(in)
+
+	sw, base := newStatusResponseWriter(w)
+
+	next(sw, r)
+
+	duration := time.Since(start)
+	status := base.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	requestsTotal.WithLabelValues(cmdPath, strconv.Itoa(status)).Inc()
+	requestDuration.WithLabelValues(cmdPath).Observe(duration.Seconds())
+	requestBytesTotal.WithLabelValues(cmdPath).Add(float64(in.n))
+	responseBytesTotal.WithLabelValues(cmdPath).Add(float64(base.out.n))
+
+	log.Infof(
+		"api command=%q status=%d duration=%s bytes_in=%d bytes_out=%d remote=%q ua=%q",
+		cmdPath, status, duration, in.n, base.out.n, r.RemoteAddr, r.Header.Get(uaHeader),
+	)
+}
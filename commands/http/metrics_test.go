@@ -0,0 +1,110 @@
+package http
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	cmds "github.com/ipfs/go-ipfs/commands"
+)
+
+func TestCommandLabel(t *testing.T) {
+	root := &cmds.Command{
+		Subcommands: map[string]*cmds.Command{
+			"pin": {
+				Subcommands: map[string]*cmds.Command{
+					"add": {},
+				},
+			},
+		},
+	}
+
+	cases := []struct {
+		cmdPath string
+		want    string
+	}{
+		{"pin/add", "pin/add"},
+		{"pin", "pin"},
+		{"pin/rm", unknownCommandLabel},
+		{"not/a/real/command", unknownCommandLabel},
+		{"", ""},
+	}
+
+	for _, c := range cases {
+		if got := commandLabel(root, c.cmdPath); got != c.want {
+			t.Errorf("commandLabel(%q) = %q, want %q", c.cmdPath, got, c.want)
+		}
+	}
+}
+
+// plainResponseWriter implements only http.ResponseWriter - no Flusher, no
+// Hijacker - so newStatusResponseWriter must not claim either capability
+// for it.
+type plainResponseWriter struct {
+	http.ResponseWriter
+}
+
+// flushingResponseWriter additionally implements http.Flusher.
+type flushingResponseWriter struct {
+	http.ResponseWriter
+	flushed bool
+}
+
+func (f *flushingResponseWriter) Flush() { f.flushed = true }
+
+func TestNewStatusResponseWriterForwardsCapabilities(t *testing.T) {
+	rec := httptest.NewRecorder()
+
+	plain := &plainResponseWriter{ResponseWriter: rec}
+	sw, _ := newStatusResponseWriter(plain)
+	if _, ok := sw.(http.Flusher); ok {
+		t.Error("newStatusResponseWriter() implements http.Flusher for a writer that doesn't")
+	}
+	if _, ok := sw.(http.Hijacker); ok {
+		t.Error("newStatusResponseWriter() implements http.Hijacker for a writer that doesn't")
+	}
+
+	flushing := &flushingResponseWriter{ResponseWriter: rec}
+	sw, _ = newStatusResponseWriter(flushing)
+	flusher, ok := sw.(http.Flusher)
+	if !ok {
+		t.Fatal("newStatusResponseWriter() doesn't implement http.Flusher for a writer that does")
+	}
+	flusher.Flush()
+	if !flushing.flushed {
+		t.Error("Flush() wasn't forwarded to the underlying http.Flusher")
+	}
+	if _, ok := sw.(http.Hijacker); ok {
+		t.Error("newStatusResponseWriter() implements http.Hijacker for a writer that doesn't")
+	}
+}
+
+// hijackingResponseWriter implements both http.Flusher and http.Hijacker.
+type hijackingResponseWriter struct {
+	http.ResponseWriter
+	hijacked bool
+}
+
+func (h *hijackingResponseWriter) Flush() {}
+
+func (h *hijackingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h.hijacked = true
+	return nil, nil, nil
+}
+
+func TestNewStatusResponseWriterForwardsHijack(t *testing.T) {
+	rec := httptest.NewRecorder()
+	underlying := &hijackingResponseWriter{ResponseWriter: rec}
+
+	sw, _ := newStatusResponseWriter(underlying)
+	hijacker, ok := sw.(http.Hijacker)
+	if !ok {
+		t.Fatal("newStatusResponseWriter() doesn't implement http.Hijacker for a writer that does")
+	}
+	hijacker.Hijack()
+	if !underlying.hijacked {
+		t.Error("Hijack() wasn't forwarded to the underlying http.Hijacker")
+	}
+}
@@ -0,0 +1,352 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	cmds "github.com/ipfs/go-ipfs/commands"
+)
+
+// rpcPath is the JSON-RPC 2.0 endpoint, served alongside the REST-ish
+// /api/v0/... routes handled by internalHandler.ServeHTTP.
+const rpcPath = "/rpc"
+
+// rpcStreamHeader opts a client into receiving a command's output as a
+// series of JSON-RPC notifications, one per JSON value in the output,
+// instead of a single buffered result. Output that isn't a sequence of JSON
+// values (such as a raw io.Reader byte stream) is not forwarded: decoding
+// stops at the first byte that isn't JSON, and only the final response
+// follows.
+const rpcStreamHeader = "X-JSON-RPC-Stream"
+
+// JSON-RPC 2.0 reserved error codes, plus a server-error range for errors
+// coming out of the command itself.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+	rpcServerError    = -32000
+	rpcUnauthorized   = -32001
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+func (req rpcRequest) isNotification() bool {
+	return len(req.ID) == 0
+}
+
+func newRPCError(id json.RawMessage, code int, message string) rpcResponse {
+	return rpcResponse{
+		JSONRPC: "2.0",
+		Error:   &rpcError{Code: code, Message: message},
+		ID:      id,
+	}
+}
+
+func newRPCResult(id json.RawMessage, result interface{}) rpcResponse {
+	return rpcResponse{JSONRPC: "2.0", Result: result, ID: id}
+}
+
+// authErrorCode maps an i.authorizeCommand error to a JSON-RPC error code.
+func authErrorCode(err error) int {
+	if err == ErrUnauthorized {
+		return rpcUnauthorized
+	}
+	return rpcInternalError
+}
+
+// handleRPC serves a JSON-RPC 2.0 request, or a batch of them, at rpcPath.
+// Rather than re-implementing argument parsing, each call is translated
+// into a synthetic /api/v0/... request and handed to the same Parse/Call
+// path that the REST-ish transport uses.
+func (i internalHandler) handleRPC(w http.ResponseWriter, r *http.Request) {
+	// authenticate before reading the body for JSON-RPC decoding: an
+	// HMAC-signed request's signature covers the request body, so it has
+	// to run (and restore r.Body) before anything else drains it.
+	identity, err := i.authenticate(r)
+	if err != nil {
+		writeRPC(w, newRPCError(nil, rpcUnauthorized, err.Error()))
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeRPC(w, newRPCError(nil, rpcParseError, err.Error()))
+		return
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		writeRPC(w, newRPCError(nil, rpcInvalidRequest, "empty request"))
+		return
+	}
+
+	if body[0] == '[' {
+		var reqs []rpcRequest
+		if err := json.Unmarshal(body, &reqs); err != nil {
+			writeRPC(w, newRPCError(nil, rpcParseError, err.Error()))
+			return
+		}
+		if len(reqs) == 0 {
+			// an empty batch array is itself an Invalid Request, not a
+			// batch of zero items.
+			writeRPC(w, newRPCError(nil, rpcInvalidRequest, "empty batch"))
+			return
+		}
+
+		resps := make([]rpcResponse, 0, len(reqs))
+		for _, req := range reqs {
+			resp, notify := i.callRPC(r, req, identity)
+			if !notify {
+				resps = append(resps, resp)
+			}
+		}
+		// JSON-RPC 2.0 requires no response at all for a batch made up
+		// entirely of notifications, as opposed to an empty array.
+		if len(resps) == 0 {
+			return
+		}
+		writeRPC(w, resps)
+		return
+	}
+
+	var req rpcRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeRPC(w, newRPCError(nil, rpcParseError, err.Error()))
+		return
+	}
+
+	if r.Header.Get(rpcStreamHeader) != "" {
+		streamRPC(w, r, i, req, identity)
+		return
+	}
+
+	resp, notify := i.callRPC(r, req, identity)
+	if !notify {
+		writeRPC(w, resp)
+	}
+}
+
+// streamRPC dispatches req and writes its output as a sequence of
+// newline-delimited JSON-RPC notifications, followed by a final response
+// carrying the original id (skipped entirely for notifications, which
+// never get a reply).
+func streamRPC(w http.ResponseWriter, httpReq *http.Request, i internalHandler, req rpcRequest, identity string) {
+	suppressFinal := req.isNotification()
+
+	if req.JSONRPC != "2.0" {
+		if !suppressFinal {
+			writeRPC(w, newRPCError(req.ID, rpcInvalidRequest, "jsonrpc must be \"2.0\""))
+		}
+		return
+	}
+
+	cmdReq, err := i.parseRPCRequest(httpReq, req)
+	if err != nil {
+		if !suppressFinal {
+			code := rpcInvalidParams
+			if err == ErrNotFound {
+				code = rpcMethodNotFound
+			}
+			writeRPC(w, newRPCError(req.ID, code, err.Error()))
+		}
+		return
+	}
+
+	if err := i.authorizeCommand(cmdReq, identity); err != nil {
+		if !suppressFinal {
+			writeRPC(w, newRPCError(req.ID, authErrorCode(err), err.Error()))
+		}
+		return
+	}
+
+	res := i.root.Call(cmdReq)
+	if e := res.Error(); e != nil {
+		if !suppressFinal {
+			code := rpcServerError
+			if e.Code == cmds.ErrClient {
+				code = rpcInvalidParams
+			}
+			writeRPC(w, newRPCError(req.ID, code, e.Error()))
+		}
+		return
+	}
+
+	out, err := res.Reader()
+	if err != nil {
+		if !suppressFinal {
+			writeRPC(w, newRPCError(req.ID, rpcInternalError, err.Error()))
+		}
+		return
+	}
+
+	w.Header().Set(contentTypeHeader, applicationJson)
+	flusher, canFlush := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	// a streamed command's output is a series of JSON values (one per
+	// channel item); forward each as its own notification as it arrives.
+	dec := json.NewDecoder(out)
+	for {
+		var chunk interface{}
+		if err := dec.Decode(&chunk); err != nil {
+			break
+		}
+		enc.Encode(rpcResponse{JSONRPC: "2.0", Result: chunk})
+		if canFlush {
+			flusher.Flush()
+		}
+	}
+
+	if !suppressFinal {
+		enc.Encode(newRPCResult(req.ID, "done"))
+	}
+}
+
+// callRPC resolves req.Method against i.root (dotted path, e.g. "pin.add"
+// resolves the same as the REST route "pin/add"), dispatches it, and
+// buffers the result into a single JSON-RPC response. The bool return is
+// true for notifications, which never get a response written.
+func (i internalHandler) callRPC(httpReq *http.Request, req rpcRequest, identity string) (rpcResponse, bool) {
+	if req.JSONRPC != "2.0" {
+		return newRPCError(req.ID, rpcInvalidRequest, "jsonrpc must be \"2.0\""), req.isNotification()
+	}
+
+	cmdReq, err := i.parseRPCRequest(httpReq, req)
+	if err != nil {
+		if err == ErrNotFound {
+			return newRPCError(req.ID, rpcMethodNotFound, err.Error()), req.isNotification()
+		}
+		return newRPCError(req.ID, rpcInvalidParams, err.Error()), req.isNotification()
+	}
+
+	if err := i.authorizeCommand(cmdReq, identity); err != nil {
+		return newRPCError(req.ID, authErrorCode(err), err.Error()), req.isNotification()
+	}
+
+	res := i.root.Call(cmdReq)
+	if e := res.Error(); e != nil {
+		code := rpcServerError
+		if e.Code == cmds.ErrClient {
+			code = rpcInvalidParams
+		}
+		return newRPCError(req.ID, code, e.Error()), req.isNotification()
+	}
+
+	result, err := bufferRPCOutput(res)
+	if err != nil {
+		return newRPCError(req.ID, rpcInternalError, err.Error()), req.isNotification()
+	}
+	return newRPCResult(req.ID, result), req.isNotification()
+}
+
+// parseRPCRequest turns a JSON-RPC method+params pair into a cmds.Request
+// by building the equivalent /api/v0/... URL and running it through Parse,
+// so JSON-RPC gets exactly the same argument and option semantics as the
+// REST-ish transport.
+func (i internalHandler) parseRPCRequest(httpReq *http.Request, req rpcRequest) (cmds.Request, error) {
+	path := "/api/v0/" + strings.Replace(req.Method, ".", "/", -1)
+
+	values := url.Values{}
+	if len(req.Params) > 0 {
+		var asArgs []interface{}
+		if err := json.Unmarshal(req.Params, &asArgs); err == nil {
+			for _, a := range asArgs {
+				values.Add("arg", toRPCParamString(a))
+			}
+		} else {
+			var asOpts map[string]interface{}
+			if err := json.Unmarshal(req.Params, &asOpts); err != nil {
+				return nil, err
+			}
+			for k, v := range asOpts {
+				if args, ok := v.([]interface{}); ok && k == "arg" {
+					for _, a := range args {
+						values.Add("arg", toRPCParamString(a))
+					}
+					continue
+				}
+				values.Set(k, toRPCParamString(v))
+			}
+		}
+	}
+
+	fullURL := path
+	if enc := values.Encode(); enc != "" {
+		fullURL += "?" + enc
+	}
+
+	synthReq, err := http.NewRequest("POST", fullURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	synthReq.Header = httpReq.Header
+
+	return Parse(synthReq, i.root)
+}
+
+func toRPCParamString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// bufferRPCOutput collects a command's response into a value suitable for
+// json.Marshal as a JSON-RPC "result" field.
+func bufferRPCOutput(res cmds.Response) (interface{}, error) {
+	out, err := res.Reader()
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := ioutil.ReadAll(out)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) == 0 {
+		return nil, nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(buf, &v); err != nil {
+		// not JSON (e.g. plain-text encoding) - return as a raw string.
+		return string(buf), nil
+	}
+	return v, nil
+}
+
+func writeRPC(w http.ResponseWriter, v interface{}) {
+	w.Header().Set(contentTypeHeader, applicationJson)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("error while writing JSON-RPC response", err)
+	}
+}